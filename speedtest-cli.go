@@ -1,17 +1,24 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/json"
 	"encoding/xml"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -20,35 +27,45 @@ import (
 const (
 	bytesPerMegabit        = 131072
 	concurrentDownloads    = 6 // not sure how the origin author picked 6
-	duplicateDownloads     = 4 // how many times do we download each image
 	configUrl              = "http://www.speedtest.net/speedtest-config.php"
+	defaultTestLengthSecs  = 10 // used if the server's testlength attr doesn't parse
+	downloadBufferSize     = 32768
+	warmUpSize             = 350
 	degToRad               = math.Pi / 180
 	earthsRadiusKm         = 6371
 	helpFlag               = "help"
 	helpHelp               = "Show this help message and exit"
+	jsonFlag               = "json"
+	jsonHelp               = "Output results as a single JSON object"
 	listFlag               = "list"
 	listHelp               = "Display a list of speedtest.net servers sorted by distance"
 	nanoSecPerMilli        = 1000000
 	numberOfClosestServers = 5
 	serverFlag             = "server"
 	serverHelp             = "Specify a server ID to test against"
-	serversUrl             = "http://www.speedtest.net/speedtest-servers.php"
+	serversUrl             = "http://www.speedtest.net/speedtest-servers-static.php"
+	serversUrlFallback     = "http://www.speedtest.net/speedtest-servers.php"
+	latencyTestResponse    = "test=test\n"
 	shareFlag              = "share"
 	shareHelp              = "Generate and provide a URL to the speedtest.net share results image"
+	shareResultsUrl        = "http://www.speedtest.net/api/api.php"
+	shareHashSalt          = "297aae72"
 	simpleFlag             = "simple"
 	simpleHelp             = "Suppress verbose output, only show basic information"
 	timesToRunLatency      = 5
 )
 
 var (
-	help   bool
-	share  bool
-	simple bool
-	list   bool
-	server string
-	// TODO: This is a hacky const-alike for the download sizes, do better
-	downloadSizes = [...]int64{350, 500, 750, 1000, 1500, 2000, 2500, 3000, 3500, 4000}
-	wg            sync.WaitGroup
+	help    bool
+	share   bool
+	simple  bool
+	list    bool
+	jsonOut bool
+	server  string
+	// the largest image speedtest.net serves, used for the bulk of the download test
+	downloadSize int64 = 4000
+	// upload payload sizes, 32KB -> 2MB
+	uploadSizes = [...]int64{32768, 65536, 131072, 262144, 524288, 1048576, 2097152}
 )
 
 type Point struct {
@@ -79,6 +96,7 @@ type Config struct {
 }
 
 type Server struct {
+	Id       int     `xml:"id,attr"`
 	Name     string  `xml:"name,attr"`
 	Sponsor  string  `xml:"sponsor,attr"`
 	Country  string  `xml:"country,attr"`
@@ -90,6 +108,16 @@ type Server struct {
 	Ping     int64   // calculated by us
 }
 
+// Result is the machine-readable summary printed by -json.
+type Result struct {
+	Client    Client  `json:"client"`
+	Server    Server  `json:"server"`
+	PingMs    int64   `json:"ping_ms"`
+	Download  float64 `json:"download_mbps"`
+	Upload    float64 `json:"upload_mbps"`
+	Timestamp string  `json:"timestamp"`
+}
+
 type Servers struct {
 	XMLName     xml.Name `xml:"settings"`
 	ServerGroup []struct {
@@ -103,6 +131,7 @@ func init() {
 	flag.BoolVar(&share, "share", false, shareHelp)
 	flag.BoolVar(&simple, "simple", false, simpleHelp)
 	flag.BoolVar(&list, "list", false, listHelp)
+	flag.BoolVar(&jsonOut, "json", false, jsonHelp)
 	flag.StringVar(&server, "server", "", serverHelp)
 }
 
@@ -112,12 +141,47 @@ func main() {
 		usage()
 		os.Exit(2)
 	}
+	if jsonOut {
+		simple = true
+	}
 	c := getConfig()
 	client := getClient(c)
-	s := getClosestServers(client)
-	b := getBestServer(s)
-	mb := downloadSpeed(b)
-	fmt.Printf("Download: %0.2f Mbit/s\n", mb)
+	if list {
+		listServers(client)
+		return
+	}
+
+	var b Server
+	if server != "" {
+		b = getServerById(client, server)
+	} else {
+		s := getClosestServers(client)
+		b = getBestServer(s)
+	}
+
+	mb := downloadSpeed(b, c.Download[0].TestLength)
+	ub := uploadSpeed(b, c.Upload[0].TestLength)
+
+	if jsonOut {
+		printResultJson(client, b, mb, ub)
+	} else {
+		fmt.Printf("Download: %0.2f Mbit/s\n", mb)
+		fmt.Printf("Upload: %0.2f Mbit/s\n", ub)
+	}
+
+	if share {
+		shareResults(b, mb, ub)
+	}
+}
+
+// parseTestLength converts the testlength attribute from speedtest.net's
+// config into seconds, falling back to a sane default if it doesn't parse.
+func parseTestLength(testLength string) int {
+	length, err := strconv.Atoi(testLength)
+	if err != nil {
+		return defaultTestLengthSecs
+	}
+	return length
 }
 
 func getClient(c Config) Client {
@@ -141,20 +205,58 @@ func getConfig() Config {
 	return config
 }
 
-// TODO: Fugly use of a map and an array, need to clean it up
-func getClosestServers(client Client) []Server {
+// getAllServers fetches the server list from the static endpoint, falling
+// back to the (rate-limited) dynamic endpoint if that fails.
+func getAllServers() []Server {
 	if simple != true {
 		fmt.Printf("Retrieving speedtest.net server list ...\n")
 	}
 	serversXml, _, err := fetchHttp(serversUrl)
 	if err != nil {
-		log.Fatal(err)
+		serversXml, _, err = fetchHttp(serversUrlFallback)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 	servers := Servers{}
 	xml.Unmarshal(serversXml, &servers)
+	return servers.ServerGroup[0].Servers
+}
+
+// getServerById fetches the full server list and returns the server whose
+// id attribute matches id, bypassing distance/latency based selection.
+func getServerById(client Client, id string) Server {
+	for _, server := range getAllServers() {
+		if strconv.Itoa(server.Id) == id {
+			server.Distance = distance(Point{client.Lat, client.Long}, Point{server.Lat, server.Long})
+			server.Ping = pingServer(server)
+			return server
+		}
+	}
+	log.Fatalf("no server found with id %s", id)
+	return Server{}
+}
 
+// listServers prints every speedtest.net server sorted by distance from
+// client, for the -list flag.
+func listServers(client Client) {
+	servers := getAllServers()
+	for i := range servers {
+		servers[i].Distance = distance(Point{client.Lat, client.Long}, Point{servers[i].Lat, servers[i].Long})
+	}
+	sort.Slice(servers, func(i, j int) bool {
+		return servers[i].Distance < servers[j].Distance
+	})
+	for _, server := range servers {
+		fmt.Printf("%5d) %s (%s, %s) [%0.2f km]\n",
+			server.Id, server.Sponsor, server.Name, server.Country, server.Distance)
+	}
+}
+
+// TODO: Fugly use of a map and an array, need to clean it up
+func getClosestServers(client Client) []Server {
 	closestServers := make(map[float64]Server)
-	for _, server := range servers.ServerGroup[0].Servers {
+	for _, server := range getAllServers() {
 		server.Distance = distance(Point{client.Lat, client.Long}, Point{server.Lat, server.Long})
 		if len(closestServers) < 5 {
 			closestServers[server.Distance] = server
@@ -187,25 +289,12 @@ func getBestServer(servers []Server) Server {
 	firstPass := true
 	var bestServer Server
 	var bestServerLock sync.Mutex
+	var wg sync.WaitGroup
 	for _, server := range servers {
 		wg.Add(1)
 		go func(server Server) {
 			defer wg.Done()
-			u, err := url.Parse(server.Url)
-			if err != nil {
-				log.Fatal(err)
-			}
-			u.Path = "/latency.txt"
-			totalDur := time.Since(time.Now())
-			for i := 0; i < timesToRunLatency; i++ {
-				_, dur, err := fetchHttp(u.String())
-				if err != nil {
-					fmt.Printf("Failure during getBestServer: %s\n", err.Error())
-					break
-				}
-				totalDur += dur
-			}
-			server.Ping = durationToMilliSeconds(totalDur) / timesToRunLatency
+			server.Ping = pingServer(server)
 			bestServerLock.Lock()
 			if firstPass || server.Ping < bestServer.Ping {
 				firstPass = false
@@ -218,12 +307,40 @@ func getBestServer(servers []Server) Server {
 	return bestServer
 }
 
-func downloadSpeed(server Server) float64 {
-	re := regexp.MustCompile("(.*)/(.+?)$")
-	ch := make(chan string)
-	totalBytes := 0.0
-	totalDur := time.Since(time.Now())
-	var totalBytesLock sync.Mutex
+// pingServer fetches /latency.txt from server up to timesToRunLatency times
+// and returns the fastest round trip time in milliseconds, discarding any
+// probe that errors or doesn't come back with the expected body (a single
+// slow TCP handshake can otherwise skew an average).
+func pingServer(server Server) int64 {
+	u, err := url.Parse(server.Url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	u.Path = "/latency.txt"
+	var bestDur time.Duration
+	samples := 0
+	for i := 0; i < timesToRunLatency; i++ {
+		body, dur, err := fetchHttp(u.String())
+		if err != nil {
+			fmt.Printf("Failure during pingServer: %s\n", err.Error())
+			continue
+		}
+		if string(body) != latencyTestResponse {
+			continue
+		}
+		if samples == 0 || dur < bestDur {
+			bestDur = dur
+		}
+		samples++
+	}
+	if samples == 0 {
+		return math.MaxInt64
+	}
+	return durationToMilliSeconds(bestDur)
+}
+
+func downloadSpeed(server Server, testLength string) float64 {
+	length := parseTestLength(testLength)
 
 	if simple != true {
 		fmt.Printf("Hosted by %s (%s) [%0.2f km] %d ms\n", server.Sponsor,
@@ -233,48 +350,180 @@ func downloadSpeed(server Server) float64 {
 	if err != nil {
 		log.Fatal(err)
 	}
-	wg.Add(1)
-	go func() { // URL Generator (producer)
-		wg.Done()
-		for _, size := range downloadSizes {
-			for i := 0; i < duplicateDownloads; i++ {
-				u.Path = re.ReplaceAllString(u.Path,
-					"$1/random"+strconv.Itoa(int(size))+"x"+strconv.Itoa(int(size))+".jpg")
-				ch <- u.String()
+	u.Path = "/random" + strconv.FormatInt(downloadSize, 10) + "x" + strconv.FormatInt(downloadSize, 10) + ".jpg"
+	downloadUrl := u.String()
+
+	// Warm up the connection with a small download so TCP slow-start
+	// doesn't skew the real measurement.
+	warmUp, err := url.Parse(server.Url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	warmUp.Path = "/random" + strconv.Itoa(warmUpSize) + "x" + strconv.Itoa(warmUpSize) + ".jpg"
+	discardHttp(warmUp.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(length)*time.Second)
+	defer cancel()
+
+	var totalBytesLock sync.Mutex
+	var totalBytes int64
+
+	if simple != true {
+		fmt.Printf("Testing download speed")
+	}
+	startTime := time.Now()
+	var downloadWg sync.WaitGroup
+	for i := 0; i < concurrentDownloads; i++ { // download workers
+		downloadWg.Add(1)
+		go func() {
+			defer downloadWg.Done()
+			for ctx.Err() == nil {
+				n := streamHttp(ctx, downloadUrl)
+				totalBytesLock.Lock()
+				totalBytes += n
+				totalBytesLock.Unlock()
+				if simple != true {
+					fmt.Printf(".")
+				}
 			}
+		}()
+	}
+	downloadWg.Wait()
+	fmt.Printf("\n")
+	bytesPerSecond := float64(totalBytes) / time.Since(startTime).Seconds()
+	megaBitsPerSecond := bytesPerSecond / bytesPerMegabit
+	return megaBitsPerSecond
+}
+
+func uploadSpeed(server Server, testLength string) float64 {
+	var uploadWg sync.WaitGroup
+	ch := make(chan []byte)
+	totalBytes := 0.0
+	var totalBytesLock sync.Mutex
+
+	length := parseTestLength(testLength)
+	deadline := time.Now().Add(time.Duration(length) * time.Second)
+
+	u, err := url.Parse(server.Url)
+	if err != nil {
+		log.Fatal(err)
+	}
+	u.Path = "/upload.php"
+
+	uploadWg.Add(1)
+	go func() { // payload generator (producer)
+		defer uploadWg.Done()
+		i := 0
+		for time.Now().Before(deadline) {
+			ch <- randomPayload(uploadSizes[i%len(uploadSizes)])
+			i++
 		}
 		close(ch)
 	}()
 
-	fmt.Printf("Testing download speed")
+	if simple != true {
+		fmt.Printf("Testing upload speed")
+	}
 	startTime := time.Now()
-	for i := 0; i < concurrentDownloads; i++ { // URL consumers
-		wg.Add(1)
+	for i := 0; i < concurrentDownloads; i++ { // payload consumers
+		uploadWg.Add(1)
 		go func() {
-			defer wg.Done()
+			defer uploadWg.Done()
 			for {
 				if simple != true {
 					fmt.Printf(".")
 				}
-				url, ok := <-ch
+				payload, ok := <-ch
 				if ok == false {
 					break
 				}
-				b, d, _ := fetchHttp(url)
+				n, _ := postHttp(u.String(), payload)
 				totalBytesLock.Lock()
-				totalBytes += float64(len(b))
-				totalDur += d
+				totalBytes += float64(n)
 				totalBytesLock.Unlock()
 			}
 		}()
 	}
-	wg.Wait()
+	uploadWg.Wait()
 	fmt.Printf("\n")
-	bytesPerSecond := totalBytes / totalDur.Seconds()
+	bytesPerSecond := totalBytes / time.Since(startTime).Seconds()
 	megaBitsPerSecond := bytesPerSecond / bytesPerMegabit
 	return megaBitsPerSecond
 }
 
+// randomPayload returns n random bytes suitable for posting as an
+// application/x-www-form-urlencoded upload body.
+func randomPayload(n int64) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func postHttp(url string, payload []byte) (int, error) {
+	res, err := http.Post(url, "application/x-www-form-urlencoded", bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+	return len(payload), nil
+}
+
+func printResultJson(client Client, server Server, download float64, upload float64) {
+	result := Result{
+		Client:    client,
+		Server:    server,
+		PingMs:    server.Ping,
+		Download:  download,
+		Upload:    upload,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+	}
+	out, err := json.Marshal(result)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(string(out))
+}
+
+// shareResults posts the completed test results to speedtest.net's results
+// API and prints a URL to the rendered results image.
+func shareResults(server Server, downloadMbps float64, uploadMbps float64) {
+	downloadKbps := int64(downloadMbps * 1000)
+	uploadKbps := int64(uploadMbps * 1000)
+	hash := md5.Sum([]byte(fmt.Sprintf("%d-%d-%d-%s", server.Ping, uploadKbps, downloadKbps, shareHashSalt)))
+
+	values := url.Values{}
+	values.Set("download", strconv.FormatInt(downloadKbps, 10))
+	values.Set("ping", strconv.FormatInt(server.Ping, 10))
+	values.Set("upload", strconv.FormatInt(uploadKbps, 10))
+	values.Set("promo", "")
+	values.Set("startmode", "1")
+	values.Set("recommendedserverid", strconv.Itoa(server.Id))
+	values.Set("accuracy", "1")
+	values.Set("serverid", strconv.Itoa(server.Id))
+	values.Set("hash", fmt.Sprintf("%x", hash))
+
+	res, err := http.PostForm(shareResultsUrl, values)
+	if err != nil {
+		fmt.Printf("Failed to share results: %s\n", err.Error())
+		return
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fmt.Printf("Failed to share results: %s\n", err.Error())
+		return
+	}
+
+	re := regexp.MustCompile(`resultid=(\d+)`)
+	matches := re.FindSubmatch(body)
+	if matches == nil {
+		fmt.Printf("Failed to share results: no resultid in response\n")
+		return
+	}
+	fmt.Printf("Share results: http://www.speedtest.net/result/%s.png\n", matches[1])
+}
+
 func durationToMilliSeconds(td time.Duration) int64 {
 	return int64(td.Nanoseconds() / nanoSecPerMilli)
 }
@@ -286,6 +535,9 @@ func fetchHttp(url string) ([]byte, time.Duration, error) {
 		return nil, time.Since(time.Now()), err
 	}
 	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, time.Since(time.Now()), fmt.Errorf("unexpected status %s fetching %s", res.Status, url)
+	}
 	body, err := ioutil.ReadAll(res.Body)
 	endTime := time.Now()
 	downloadTime := endTime.Sub(startTime)
@@ -295,6 +547,43 @@ func fetchHttp(url string) ([]byte, time.Duration, error) {
 	return body, downloadTime, nil
 }
 
+// streamHttp issues a GET against url and counts bytes actually read off
+// res.Body until ctx is done or the response is fully drained, reading into
+// a fixed buffer rather than buffering the whole response in memory.
+func streamHttp(ctx context.Context, url string) int64 {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0
+	}
+	defer res.Body.Close()
+
+	buf := make([]byte, downloadBufferSize)
+	var total int64
+	for {
+		n, err := res.Body.Read(buf)
+		total += int64(n)
+		if err != nil {
+			break
+		}
+	}
+	return total
+}
+
+// discardHttp fetches url and throws away the body; used for the download
+// warm-up request.
+func discardHttp(url string) {
+	res, err := http.Get(url)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+}
+
 func distance(origin Point, destination Point) float64 {
 	dlat := (destination.Lat - origin.Lat) * degToRad
 	dlon := (destination.Long - origin.Long) * degToRad
@@ -308,7 +597,7 @@ func distance(origin Point, destination Point) float64 {
 
 func usage() {
 	fmt.Printf("usage: %s [-%s] [-%s] ", os.Args[0], helpFlag, shareFlag)
-	fmt.Printf("[-%s] [-%s] [-%s SERVER]\n\n", simpleFlag, listFlag, serverFlag)
+	fmt.Printf("[-%s] [-%s] [-%s] [-%s SERVER]\n\n", simpleFlag, listFlag, jsonFlag, serverFlag)
 	fmt.Printf("Command line interface for testing internet bandwidth using speedtest.net.\n")
 	fmt.Printf("--------------------------------------------------------------------------\n")
 	fmt.Printf("https://github.com/robertmeta/speedtest-cli\n")
@@ -319,5 +608,6 @@ func usage() {
 	fmt.Printf("\t-%s\t\t\t%s\n", shareFlag, shareHelp)
 	fmt.Printf("\t-%s\t\t\t%s\n", simpleFlag, simpleHelp)
 	fmt.Printf("\t-%s\t\t\t%s\n", listFlag, listHelp)
+	fmt.Printf("\t-%s\t\t\t%s\n", jsonFlag, jsonHelp)
 	fmt.Printf("\t-%s SERVER\t\t%s\n", serverFlag, serverHelp)
 }
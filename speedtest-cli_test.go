@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPingServer(t *testing.T) {
+	cases := []struct {
+		name     string
+		response string
+		status   int
+		wantOk   bool
+	}{
+		{"valid latency response", latencyTestResponse, http.StatusOK, true},
+		{"unexpected body", "garbage\n", http.StatusOK, false},
+		{"server error", latencyTestResponse, http.StatusInternalServerError, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(c.status)
+				fmt.Fprint(w, c.response)
+			}))
+			defer ts.Close()
+
+			server := Server{Url: ts.URL}
+			ping := pingServer(server)
+			if c.wantOk && ping == math.MaxInt64 {
+				t.Fatalf("pingServer() returned no samples for a valid response")
+			}
+			if !c.wantOk && ping != math.MaxInt64 {
+				t.Fatalf("pingServer() = %d, want no samples (MaxInt64)", ping)
+			}
+		})
+	}
+}
+
+func TestGetBestServer(t *testing.T) {
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, latencyTestResponse)
+	}))
+	defer fast.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer slow.Close()
+
+	servers := []Server{
+		{Name: "slow", Url: slow.URL},
+		{Name: "fast", Url: fast.URL},
+	}
+
+	best := getBestServer(servers)
+	if best.Name != "fast" {
+		t.Fatalf("getBestServer() = %q, want %q", best.Name, "fast")
+	}
+}
+
+func TestUploadSpeed(t *testing.T) {
+	simple = true
+	defer func() { simple = false }()
+
+	t.Run("reports bytes sent", func(t *testing.T) {
+		var totalReceived int64
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			atomic.AddInt64(&totalReceived, int64(len(body)))
+		}))
+		defer ts.Close()
+
+		mbps := uploadSpeed(Server{Url: ts.URL}, "1")
+		if mbps <= 0 {
+			t.Fatalf("uploadSpeed() = %v, want > 0", mbps)
+		}
+		if atomic.LoadInt64(&totalReceived) == 0 {
+			t.Fatalf("server received no upload bytes")
+		}
+	})
+
+	t.Run("measures actual elapsed time, not the configured length", func(t *testing.T) {
+		// The producer stops at the deadline, but in-flight posts against a
+		// slow handler keep running past it; the reported rate must come
+		// from wall-clock elapsed time or it will be inflated.
+		var totalReceived int64
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+			body, _ := ioutil.ReadAll(r.Body)
+			atomic.AddInt64(&totalReceived, int64(len(body)))
+		}))
+		defer ts.Close()
+
+		testLengthSecs := 1.0
+		start := time.Now()
+		mbps := uploadSpeed(Server{Url: ts.URL}, "1")
+		actualElapsed := time.Since(start).Seconds()
+
+		if actualElapsed <= testLengthSecs {
+			t.Fatalf("slow handler should have pushed the real elapsed time past the configured %vs, got %vs", testLengthSecs, actualElapsed)
+		}
+
+		received := float64(atomic.LoadInt64(&totalReceived))
+		nominalMbps := (received / testLengthSecs) / bytesPerMegabit
+		if mbps >= nominalMbps {
+			t.Fatalf("uploadSpeed() = %v, want less than the nominal-duration rate %v now that the test overran its deadline", mbps, nominalMbps)
+		}
+
+		wantMbps := (received / actualElapsed) / bytesPerMegabit
+		if diff := math.Abs(mbps-wantMbps) / wantMbps; diff > 0.2 {
+			t.Fatalf("uploadSpeed() = %v, want ~%v (within 20%%) based on actual elapsed time %vs", mbps, wantMbps, actualElapsed)
+		}
+	})
+}